@@ -7,27 +7,52 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/bmatcuk/doublestar"
 	"github.com/dimchansky/utfbom"
 	"github.com/pkg/errors"
-	"go.mozilla.org/sops"
-	sopscommon "go.mozilla.org/sops/cmd/sops/common"
-	sopsdecrypt "go.mozilla.org/sops/decrypt"
+	"go.mozilla.org/sops/v3"
+	sopsaes "go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/azkv"
+	sopscommon "go.mozilla.org/sops/v3/cmd/sops/common"
+	sopsformats "go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/gcpkms"
+	"go.mozilla.org/sops/v3/hcvault"
+	"go.mozilla.org/sops/v3/keys"
+	"go.mozilla.org/sops/v3/keyservice"
+	"go.mozilla.org/sops/v3/kms"
+	"go.mozilla.org/sops/v3/pgp"
+	sopsdotenv "go.mozilla.org/sops/v3/stores/dotenv"
+	sopsjson "go.mozilla.org/sops/v3/stores/json"
+	sopsyaml "go.mozilla.org/sops/v3/stores/yaml"
+	"google.golang.org/grpc"
 	"gopkg.in/yaml.v2"
 )
 
 const (
 	apiVersion = "kustomize.meiqia.com/v1beta1"
 	kind       = "SopsSecretGenerator"
+
+	resourceListAPIVersion = "config.kubernetes.io/v1"
+	resourceListKind       = "ResourceList"
 )
 
 type kvMap map[string]string
@@ -50,87 +75,266 @@ type ObjectMeta struct {
 type SopsSecretGenerator struct {
 	TypeMeta              `json:",inline" yaml:",inline"`
 	ObjectMeta            `json:"metadata" yaml:"metadata"`
-	EnvSources            []string `json:"envs" yaml:"envs"`
-	FileSources           []string `json:"files" yaml:"files"`
-	Behavior              string   `json:"behavior,omitempty" yaml:"behavior,omitempty"`
-	DisableNameSuffixHash bool     `json:"disableNameSuffixHash,omitempty" yaml:"disableNameSuffixHash,omitempty"`
-	Type                  string   `json:"type,omitempty" yaml:"type,omitempty"`
+	EnvSources            []EnvSource  `json:"envs" yaml:"envs"`
+	FileSources           []FileSource `json:"files" yaml:"files"`
+	Behavior              string       `json:"behavior,omitempty" yaml:"behavior,omitempty"`
+	DisableNameSuffixHash bool         `json:"disableNameSuffixHash,omitempty" yaml:"disableNameSuffixHash,omitempty"`
+	Type                  string       `json:"type,omitempty" yaml:"type,omitempty"`
+	PartialEncryption     bool         `json:"partialEncryption,omitempty" yaml:"partialEncryption,omitempty"`
+	GenerateConfigMap     bool         `json:"generateConfigMap,omitempty" yaml:"generateConfigMap,omitempty"`
+	UseStringData         bool         `json:"useStringData,omitempty" yaml:"useStringData,omitempty"`
+	KeyServiceURIs        []string     `json:"keyServiceURIs,omitempty" yaml:"keyServiceURIs,omitempty"`
+	DecryptionOrder       []string     `json:"decryptionOrder,omitempty" yaml:"decryptionOrder,omitempty"`
+	Age                   AgeConfig    `json:"age,omitempty" yaml:"age,omitempty"`
+}
+
+// AgeConfig configures the age backend for a generator, letting it point
+// at specific identity files instead of relying solely on the
+// SOPS_AGE_KEY_FILE environment variable.
+type AgeConfig struct {
+	IdentityFiles []string `json:"identityFiles,omitempty" yaml:"identityFiles,omitempty"`
+}
+
+// EnvSource configures a single `envs` entry. It unmarshals from a bare
+// path string, keeping the previous flat syntax working, or from an
+// object for sources that need nested-key flattening control:
+//
+//	envs:
+//	  - secrets.enc.yaml
+//	  - path: nested-secrets.enc.yaml
+//	    flatten: true
+//	    delimiter: "."
+type EnvSource struct {
+	Path      string `json:"path" yaml:"path"`
+	Flatten   bool   `json:"flatten,omitempty" yaml:"flatten,omitempty"`
+	Delimiter string `json:"delimiter,omitempty" yaml:"delimiter,omitempty"`
+}
+
+// UnmarshalYAML accepts either a bare path string or an EnvSource object,
+// defaulting Flatten to true and Delimiter to "." in both cases.
+func (e *EnvSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*e = EnvSource{Path: path, Flatten: true, Delimiter: "."}
+		return nil
+	}
+
+	type plain EnvSource
+	aux := plain{Flatten: true, Delimiter: "."}
+	if err := unmarshal(&aux); err != nil {
+		return err
+	}
+	*e = EnvSource(aux)
+	return nil
+}
+
+// FileSource configures a single `files` entry. It unmarshals from the
+// legacy bare "path" or explicit "key=path" string, or from an object so
+// one entry can expand into many keys via a doublestar glob or a
+// directory:
+//
+//	files:
+//	  - certs/server.pem
+//	  - tls.key=certs/server.key
+//	  - path: "certs/**/*.pem"
+//	    keyPrefix: "tls-"
+type FileSource struct {
+	Path      string `json:"path" yaml:"path"`
+	KeyPrefix string `json:"keyPrefix,omitempty" yaml:"keyPrefix,omitempty"`
+}
+
+// UnmarshalYAML accepts either a bare "path" or "key=path" string, or a
+// FileSource object.
+func (f *FileSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*f = FileSource{Path: path}
+		return nil
+	}
+
+	var aux FileSource
+	if err := unmarshal(&aux); err != nil {
+		return err
+	}
+	*f = aux
+	return nil
 }
 
 // Secret is a Kubernetes Secret
 type Secret struct {
 	TypeMeta   `json:",inline" yaml:",inline"`
 	ObjectMeta `json:"metadata" yaml:"metadata"`
-	Data       kvMap  `json:"data" yaml:"data"`
+	Data       kvMap  `json:"data,omitempty" yaml:"data,omitempty"`
+	StringData kvMap  `json:"stringData,omitempty" yaml:"stringData,omitempty"`
 	Type       string `json:"type,omitempty" yaml:"type,omitempty"`
 }
 
+// ConfigMap is a Kubernetes ConfigMap. It is generated alongside a Secret
+// when GenerateConfigMap is set, holding the plaintext leaves of a
+// partially-encrypted source that don't belong in the Secret.
+type ConfigMap struct {
+	TypeMeta   `json:",inline" yaml:",inline"`
+	ObjectMeta `json:"metadata" yaml:"metadata"`
+	Data       kvMap `json:"data" yaml:"data"`
+}
+
+// ResourceList is the envelope exchanged over stdin/stdout by the KRM
+// Function Specification: a list of resources plus an optional
+// functionConfig. Items are kept as yaml.MapSlice so resources this
+// binary does not understand pass through unmodified and in order.
+type ResourceList struct {
+	APIVersion     string          `yaml:"apiVersion"`
+	Kind           string          `yaml:"kind"`
+	Items          []yaml.MapSlice `yaml:"items"`
+	FunctionConfig yaml.MapSlice   `yaml:"functionConfig"`
+}
+
 func main() {
-	if len(os.Args) != 2 {
+	args := os.Args[1:]
+	// The container-based KRM function entrypoint invokes the image as
+	// `entrypoint -- `, with the actual configuration arriving as the
+	// functionConfig of the ResourceList on stdin.
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	if len(args) == 0 && stdinHasResourceList() {
+		output, err := processResourceList(os.Stdin)
+		if err != nil {
+			reportError(err)
+		}
+		fmt.Print(output)
+		return
+	}
+
+	if len(args) != 1 {
 		_, _ = fmt.Fprintln(os.Stderr, "usage: SopsSecretGenerator FILE")
 		os.Exit(1)
 	}
 
-	output, err := processSopsSecretGenerator(os.Args[1])
+	output, err := processSopsSecretGenerator(args[0])
 	if err != nil {
-		if sopsErr, ok := errors.Cause(err).(sops.UserError); ok {
-			_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n%s\n", err, sopsErr.UserError())
-		} else {
-			_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		}
-		os.Exit(2)
+		reportError(err)
 	}
 	fmt.Print(output)
 }
 
+func reportError(err error) {
+	if sopsErr, ok := errors.Cause(err).(sops.UserError); ok {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n%s\n", err, sopsErr.UserError())
+	} else {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(2)
+}
+
+// stdinHasResourceList reports whether stdin looks like a pipe carrying a
+// KRM Function Specification ResourceList rather than an interactive
+// terminal, so that running the binary with no file argument falls back
+// to the usage error instead of blocking on a read.
+func stdinHasResourceList() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice == 0
+}
+
 func processSopsSecretGenerator(fn string) (string, error) {
 	input, err := readInput(fn)
 	if err != nil {
 		return "", err
 	}
-	secret, err := generateSecret(input)
+	secret, configMap, err := generateResources(input)
 	if err != nil {
 		return "", err
 	}
+	return marshalResources(secret, configMap)
+}
+
+// marshalResources renders secret, followed by configMap as a second YAML
+// document when present, matching how kustomize's own generators emit
+// multiple resources from a single plugin invocation.
+func marshalResources(secret Secret, configMap *ConfigMap) (string, error) {
 	output, err := yaml.Marshal(secret)
 	if err != nil {
 		return "", err
 	}
-	return string(output), nil
+	if configMap == nil {
+		return string(output), nil
+	}
+	configMapOutput, err := yaml.Marshal(configMap)
+	if err != nil {
+		return "", err
+	}
+	return string(output) + "---\n" + string(configMapOutput), nil
 }
 
-func generateSecret(sopsSecret SopsSecretGenerator) (Secret, error) {
+func generateResources(sopsSecret SopsSecretGenerator) (Secret, *ConfigMap, error) {
 	data, err := parseInput(sopsSecret)
 	if err != nil {
-		return Secret{}, err
+		return Secret{}, nil, err
 	}
 
-	annotations := make(kvMap)
-	for k, v := range sopsSecret.Annotations {
-		annotations[k] = v
+	secret := Secret{
+		TypeMeta: TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: ObjectMeta{
+			Name:        sopsSecret.Name,
+			Namespace:   sopsSecret.Namespace,
+			Labels:      sopsSecret.Labels,
+			Annotations: generatorAnnotations(sopsSecret),
+		},
+		Type: sopsSecret.Type,
 	}
-	if !sopsSecret.DisableNameSuffixHash {
-		annotations["kustomize.config.k8s.io/needs-hash"] = "true"
+	if sopsSecret.UseStringData {
+		secret.StringData = data.secret
+	} else {
+		secret.Data = encodeBase64(data.secret)
 	}
-	if sopsSecret.Behavior != "" {
-		annotations["kustomize.config.k8s.io/behavior"] = sopsSecret.Behavior
+
+	if !sopsSecret.GenerateConfigMap || len(data.configMap) == 0 {
+		return secret, nil, nil
 	}
 
-	secret := Secret{
+	configMap := ConfigMap{
 		TypeMeta: TypeMeta{
 			APIVersion: "v1",
-			Kind:       "Secret",
+			Kind:       "ConfigMap",
 		},
 		ObjectMeta: ObjectMeta{
 			Name:        sopsSecret.Name,
 			Namespace:   sopsSecret.Namespace,
 			Labels:      sopsSecret.Labels,
-			Annotations: annotations,
+			Annotations: generatorAnnotations(sopsSecret),
 		},
-		Data: data,
-		Type: sopsSecret.Type,
+		Data: data.configMap,
 	}
-	return secret, nil
+	return secret, &configMap, nil
+}
+
+func generatorAnnotations(sopsSecret SopsSecretGenerator) kvMap {
+	annotations := make(kvMap)
+	for k, v := range sopsSecret.Annotations {
+		annotations[k] = v
+	}
+	if !sopsSecret.DisableNameSuffixHash {
+		annotations["kustomize.config.k8s.io/needs-hash"] = "true"
+	}
+	if sopsSecret.Behavior != "" {
+		annotations["kustomize.config.k8s.io/behavior"] = sopsSecret.Behavior
+	}
+	return annotations
+}
+
+func encodeBase64(raw kvMap) kvMap {
+	data := make(kvMap, len(raw))
+	for k, v := range raw {
+		data[k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return data
 }
 
 func readInput(fn string) (SopsSecretGenerator, error) {
@@ -138,14 +342,17 @@ func readInput(fn string) (SopsSecretGenerator, error) {
 	if err != nil {
 		return SopsSecretGenerator{}, err
 	}
+	return parseSopsSecretGenerator(content)
+}
 
+func parseSopsSecretGenerator(content []byte) (SopsSecretGenerator, error) {
 	input := SopsSecretGenerator{
 		TypeMeta: TypeMeta{},
 		ObjectMeta: ObjectMeta{
 			Annotations: make(kvMap),
 		},
 	}
-	err = yaml.Unmarshal(content, &input)
+	err := yaml.Unmarshal(content, &input)
 	if err != nil {
 		return SopsSecretGenerator{}, err
 	}
@@ -159,56 +366,677 @@ func readInput(fn string) (SopsSecretGenerator, error) {
 	return input, nil
 }
 
-func parseInput(input SopsSecretGenerator) (kvMap, error) {
-	data := make(kvMap)
-	err := parseEnvSources(input.EnvSources, data)
+// processResourceList implements the KRM Function Specification mode: it
+// reads a ResourceList from r, treats its functionConfig as the
+// SopsSecretGenerator, generates the Secret and appends it to items, then
+// re-emits the ResourceList.
+func processResourceList(r io.Reader) (string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	list := ResourceList{
+		APIVersion: resourceListAPIVersion,
+		Kind:       resourceListKind,
+	}
+	err = yaml.Unmarshal(content, &list)
+	if err != nil {
+		return "", err
+	}
+
+	functionConfigContent, err := yaml.Marshal(list.FunctionConfig)
+	if err != nil {
+		return "", err
+	}
+	sopsSecret, err := parseSopsSecretGenerator(functionConfigContent)
+	if err != nil {
+		return "", err
+	}
+
+	secret, configMap, err := generateResources(sopsSecret)
+	if err != nil {
+		return "", err
+	}
+
+	secret.Annotations = traceAnnotations(secret.Annotations, list.FunctionConfig, len(list.Items))
+	item, err := toMapSlice(secret)
+	if err != nil {
+		return "", err
+	}
+	list.Items = append(list.Items, item)
+
+	if configMap != nil {
+		configMap.Annotations = traceAnnotations(configMap.Annotations, list.FunctionConfig, len(list.Items))
+		configMapItem, err := toMapSlice(configMap)
+		if err != nil {
+			return "", err
+		}
+		list.Items = append(list.Items, configMapItem)
+	}
+
+	output, err := yaml.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// traceAnnotations copies the config.kubernetes.io/* annotations (source
+// path, and so on) from the functionConfig onto base, and stamps index
+// among the ResourceList items, so downstream KRM functions can trace
+// where the generated resource came from.
+func traceAnnotations(base kvMap, functionConfig yaml.MapSlice, index int) kvMap {
+	annotations := make(kvMap, len(base))
+	for k, v := range base {
+		annotations[k] = v
+	}
+	for k, v := range annotationsOf(functionConfig) {
+		if strings.HasPrefix(k, "config.kubernetes.io/") {
+			annotations[k] = v
+		}
+	}
+	annotations["config.kubernetes.io/index"] = strconv.Itoa(index)
+	return annotations
+}
+
+func annotationsOf(resource yaml.MapSlice) kvMap {
+	annotations := make(kvMap)
+	metadata, ok := mapSliceValue(resource, "metadata")
+	if !ok {
+		return annotations
+	}
+	metadataSlice, ok := metadata.(yaml.MapSlice)
+	if !ok {
+		return annotations
+	}
+	rawAnnotations, ok := mapSliceValue(metadataSlice, "annotations")
+	if !ok {
+		return annotations
+	}
+	annotationsSlice, ok := rawAnnotations.(yaml.MapSlice)
+	if !ok {
+		return annotations
+	}
+	for _, item := range annotationsSlice {
+		k, kok := item.Key.(string)
+		v, vok := item.Value.(string)
+		if kok && vok {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+func mapSliceValue(m yaml.MapSlice, key string) (interface{}, bool) {
+	for _, item := range m {
+		if k, ok := item.Key.(string); ok && k == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// toMapSlice round-trips v through YAML into a yaml.MapSlice so it can be
+// appended to a ResourceList's items alongside resources this binary does
+// not otherwise understand.
+func toMapSlice(v interface{}) (yaml.MapSlice, error) {
+	content, err := yaml.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
-	err = parseFileSources(input.FileSources, data)
+	var item yaml.MapSlice
+	err = yaml.Unmarshal(content, &item)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// parsedData holds decrypted, not-yet-encoded values: secret is destined
+// for the generated Secret's data/stringData, configMap for the companion
+// ConfigMap's data when GenerateConfigMap routes plaintext leaves there.
+type parsedData struct {
+	secret    kvMap
+	configMap kvMap
+}
+
+// decryptOptions carries a generator's multi-backend decryption
+// configuration (which sops key-service endpoints to ask and which
+// master-key type to try first) down to where sources are actually
+// decrypted. Age identity files are not part of it: parseInput passes
+// them to sops through SOPS_AGE_KEY_FILE.
+type decryptOptions struct {
+	KeyServiceURIs  []string
+	DecryptionOrder []string
+}
+
+func newDecryptOptions(input SopsSecretGenerator) decryptOptions {
+	return decryptOptions{
+		KeyServiceURIs:  input.KeyServiceURIs,
+		DecryptionOrder: input.DecryptionOrder,
+	}
+}
+
+func parseInput(input SopsSecretGenerator) (*parsedData, error) {
+	if len(input.Age.IdentityFiles) > 0 {
+		if err := os.Setenv("SOPS_AGE_KEY_FILE", strings.Join(input.Age.IdentityFiles, ",")); err != nil {
+			return nil, err
+		}
+	}
+	opts := newDecryptOptions(input)
+	dec := newDecryptor()
+
+	data := &parsedData{secret: make(kvMap), configMap: make(kvMap)}
+	err := parseEnvSources(input.EnvSources, input.PartialEncryption, input.GenerateConfigMap, opts, dec, data)
+	if err != nil {
+		return nil, err
+	}
+	err = parseFileSources(input.FileSources, opts, dec, data.secret)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func parseEnvSources(sources []string, data kvMap) error {
+func parseEnvSources(sources []EnvSource, partialEncryption, generateConfigMap bool, opts decryptOptions, dec decryptor, data *parsedData) error {
 	for _, source := range sources {
-		err := parseEnvSource(source, data)
+		paths, err := expandSourcePaths(source.Path, true)
 		if err != nil {
-			return errors.Wrapf(err, "env source %v", source)
+			return errors.Wrapf(err, "env source %v", source.Path)
+		}
+		for _, p := range paths {
+			expanded := source
+			expanded.Path = p
+			if err := parseEnvSource(expanded, partialEncryption, generateConfigMap, opts, dec, data); err != nil {
+				return errors.Wrapf(err, "env source %v", p)
+			}
 		}
 	}
 	return nil
 }
 
-func parseEnvSource(source string, data kvMap) error {
-	content, err := ioutil.ReadFile(source)
+// expandSourcePaths resolves a single envs/files source path that isn't
+// the legacy explicit "key=path" files syntax: doublestar glob patterns
+// (e.g. "secrets/**/*.enc.yaml") are expanded, directories are walked
+// recursively, and anything else is returned as-is so a plain file path
+// keeps working exactly as before. When onlySupportedFormats is set
+// (envs sources), directory entries are filtered to files formatForPath
+// recognizes; files sources keep every file, since they are often opaque
+// blobs such as certificates.
+func expandSourcePaths(pattern string, onlySupportedFormats bool) ([]string, error) {
+	if containsGlobMeta(pattern) {
+		matches, err := doublestar.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		return matches, nil
+	}
+
+	info, err := os.Stat(pattern)
+	if err != nil || !info.IsDir() {
+		return []string{pattern}, nil
+	}
+
+	var matches []string
+	err = filepath.Walk(pattern, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if onlySupportedFormats && formatForPath(p) == "binary" {
+			return nil
+		}
+		matches = append(matches, p)
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func containsGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
 
-	format := formatForPath(source)
-	decrypted, err := sopsdecrypt.Data(content, format)
+// setUnique writes value into data under key, rejecting a key that a
+// previous source already populated instead of silently overwriting it.
+func setUnique(data kvMap, key, value string) error {
+	if _, exists := data[key]; exists {
+		return errors.Errorf("duplicate key %q", key)
+	}
+	data[key] = value
+	return nil
+}
+
+func parseEnvSource(source EnvSource, partialEncryption, generateConfigMap bool, opts decryptOptions, dec decryptor, data *parsedData) error {
+	format := formatForPath(source.Path)
+	if format != "yaml" && format != "json" {
+		if partialEncryption {
+			return errors.New("partialEncryption requires a yaml or json source")
+		}
+		decrypted, err := dec.decryptBytes(source.Path, format, opts)
+		if err != nil {
+			return err
+		}
+		if format == "dotenv" {
+			return parseDotEnvContent(decrypted, data.secret)
+		}
+		return errors.New("unknown file format, use dotenv, yaml or json")
+	}
+
+	delimiter := source.Delimiter
+	if delimiter == "" {
+		delimiter = "."
+	}
+	value, encrypted, err := dec.decryptTree(source.Path, format, delimiter, opts)
 	if err != nil {
 		return err
 	}
 
+	if partialEncryption {
+		return routePartialLeaves(value, encrypted, delimiter, generateConfigMap, data)
+	}
+	return flattenInto(value, source, data.secret)
+}
+
+// routePartialLeaves splits the leaves of a partially-encrypted source
+// between the Secret and, when generateConfigMap is set, the companion
+// ConfigMap: only leaves SOPS considered encrypted (per encrypted map)
+// go into the Secret.
+func routePartialLeaves(value interface{}, encrypted map[string]bool, delimiter string, generateConfigMap bool, data *parsedData) error {
+	leaves := make(map[string]interface{})
+	flattenValue("", value, delimiter, leaves)
+
+	var invalidKeys []string
+	for leafPath, v := range leaves {
+		dest := data.secret
+		if !encrypted[leafPath] {
+			if !generateConfigMap {
+				continue
+			}
+			dest = data.configMap
+		}
+		if !isValidDataKey(leafPath) {
+			invalidKeys = append(invalidKeys, leafPath)
+			continue
+		}
+		s, err := scalarToString(v)
+		if err != nil {
+			return err
+		}
+		if err := setUnique(dest, leafPath, s); err != nil {
+			return err
+		}
+	}
+	if len(invalidKeys) > 0 {
+		sort.Strings(invalidKeys)
+		return errors.Errorf("invalid secret key(s): %s", strings.Join(invalidKeys, ", "))
+	}
+	return nil
+}
+
+// decryptor turns a source's ciphertext into plaintext. parseEnvSource and
+// parseFileSource call through this seam instead of talking to sops
+// directly, so an on-disk cache can sit in front of the real decryption
+// without either caller knowing the difference.
+type decryptor interface {
+	// decryptTree decrypts the yaml/json file at path and returns it as
+	// the map/slice/scalar shape flattenValue expects, alongside which
+	// leaves SOPS considered encrypted.
+	decryptTree(path, format, delimiter string, opts decryptOptions) (interface{}, map[string]bool, error)
+	// decryptBytes decrypts path in full and returns the re-marshaled
+	// plaintext document for yaml, json and dotenv sources, or the raw
+	// decrypted bytes for binary sources (certs, keys and other opaque
+	// files passed through `files:`).
+	decryptBytes(path, format string, opts decryptOptions) ([]byte, error)
+}
+
+// liveDecryptor is the default decryptor: every call goes straight to sops.
+type liveDecryptor struct{}
+
+func (liveDecryptor) decryptTree(path, format, delimiter string, opts decryptOptions) (interface{}, map[string]bool, error) {
+	tree, err := decryptSopsTree(path, format, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted := make(map[string]bool)
+	value := branchToValue(tree.Branches[0], tree.Metadata, "", delimiter, encrypted)
+	return value, encrypted, nil
+}
+
+func (liveDecryptor) decryptBytes(path, format string, opts decryptOptions) ([]byte, error) {
+	tree, err := decryptSopsTree(path, format, opts)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storeForFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return store.EmitPlainFile(tree.Branches)
+}
+
+const (
+	// cacheEnvVar opts a generator invocation into the on-disk decrypt
+	// cache below. It defaults to off because cache entries hold
+	// plaintext.
+	cacheEnvVar = "SOPS_SECRET_GEN_CACHE"
+	// cacheTTL bounds how long a cache entry is trusted before it is
+	// treated as a miss and re-decrypted, so a key rotation or an edit
+	// made within the same second as a previous build doesn't stick
+	// around indefinitely.
+	cacheTTL = 10 * time.Minute
+)
+
+// newDecryptor returns the decryptor sources should use: the plain
+// sops-backed implementation, or that implementation wrapped in an
+// on-disk cache when SOPS_SECRET_GEN_CACHE=1 is set. Caching lets
+// base/overlay layouts that reference the same encrypted file from
+// several SopsSecretGenerator inputs pay for one sops decryption per
+// kustomize build, even though kustomize execs this binary once per
+// generator.
+func newDecryptor() decryptor {
+	if os.Getenv(cacheEnvVar) != "1" {
+		return liveDecryptor{}
+	}
+	dir, err := decryptCacheDir()
+	if err != nil {
+		return liveDecryptor{}
+	}
+	return cachingDecryptor{inner: liveDecryptor{}, dir: dir}
+}
+
+func decryptCacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "kustomize-sopssecretgenerator")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// cachingDecryptor wraps another decryptor with a plaintext, 0600 on-disk
+// cache keyed by a source's absolute path, size, mtime and decryptOptions,
+// so a file referenced from multiple SopsSecretGenerator inputs across a
+// single kustomize build is only decrypted once per distinct backend
+// configuration.
+type cachingDecryptor struct {
+	inner decryptor
+	dir   string
+}
+
+// cacheEntry is the JSON payload stored per cache key. Only the fields
+// relevant to the call that produced it are populated.
+type cacheEntry struct {
+	StoredAt  time.Time       `json:"storedAt"`
+	Bytes     []byte          `json:"bytes,omitempty"`
+	Value     interface{}     `json:"value,omitempty"`
+	Encrypted map[string]bool `json:"encrypted,omitempty"`
+}
+
+func (c cachingDecryptor) decryptTree(path, format, delimiter string, opts decryptOptions) (interface{}, map[string]bool, error) {
+	key, keyErr := c.cacheKey("tree", path, format, delimiter, opts)
+	if keyErr == nil {
+		if entry, ok := c.load(key); ok {
+			return entry.Value, entry.Encrypted, nil
+		}
+	}
+	value, encrypted, err := c.inner.decryptTree(path, format, delimiter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyErr == nil {
+		c.store(key, cacheEntry{Value: value, Encrypted: encrypted})
+	}
+	return value, encrypted, nil
+}
+
+func (c cachingDecryptor) decryptBytes(path, format string, opts decryptOptions) ([]byte, error) {
+	key, keyErr := c.cacheKey("bytes", path, format, "", opts)
+	if keyErr == nil {
+		if entry, ok := c.load(key); ok {
+			return entry.Bytes, nil
+		}
+	}
+	content, err := c.inner.decryptBytes(path, format, opts)
+	if err != nil {
+		return nil, err
+	}
+	if keyErr == nil {
+		c.store(key, cacheEntry{Bytes: content})
+	}
+	return content, nil
+}
+
+// cacheKey fingerprints a source so a cache entry is invalidated the
+// moment the underlying file's size or mtime changes, and is scoped to
+// opts so two generators decrypting the same file through different
+// key-service/decryption-order configurations never share an entry.
+func (c cachingDecryptor) cacheKey(kind, path, format, delimiter string, opts decryptOptions) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%d\x00%d\x00%s", kind, abs, format, delimiter, info.Size(), info.ModTime().UnixNano(), optsFingerprint(opts))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// optsFingerprint renders a decryptOptions as a string suitable for
+// folding into cacheKey, so entries naturally differ per
+// keyServiceURIs/decryptionOrder configuration.
+func optsFingerprint(opts decryptOptions) string {
+	return strings.Join(opts.KeyServiceURIs, ",") + "\x00" + strings.Join(opts.DecryptionOrder, ",")
+}
+
+func (c cachingDecryptor) entryPath(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c cachingDecryptor) load(key string) (cacheEntry, bool) {
+	content, err := ioutil.ReadFile(c.entryPath(key))
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return cacheEntry{}, false
+	}
+	if time.Since(entry.StoredAt) > cacheTTL {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c cachingDecryptor) store(key string, entry cacheEntry) {
+	entry.StoredAt = time.Now()
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_ = ioutil.WriteFile(c.entryPath(key), content, 0600)
+}
+
+// decryptSopsTree loads path through the matching sops.Store and decrypts
+// it via sopscommon.DecryptTree, trying opts.KeyServiceURIs in addition to
+// the local key service, and reordering each key group per
+// opts.DecryptionOrder.
+func decryptSopsTree(path, format string, opts decryptOptions) (sops.Tree, error) {
+	store, err := storeForFormat(format)
+	if err != nil {
+		return sops.Tree{}, err
+	}
+	tree, err := sopscommon.LoadEncryptedFile(store, path)
+	if err != nil {
+		return sops.Tree{}, err
+	}
+
+	reorderKeyGroups(tree.Metadata.KeyGroups, opts.DecryptionOrder)
+
+	keyServices, err := keyServiceClients(opts.KeyServiceURIs)
+	if err != nil {
+		return sops.Tree{}, err
+	}
+	_, err = sopscommon.DecryptTree(sopscommon.DecryptTreeOpts{
+		Tree:        tree,
+		KeyServices: keyServices,
+		Cipher:      sopsaes.NewCipher(),
+	})
+	if err != nil {
+		return sops.Tree{}, err
+	}
+	return *tree, nil
+}
+
+func storeForFormat(format string) (sops.Store, error) {
 	switch format {
-	case "dotenv":
-		err = parseDotEnvContent(decrypted, data)
 	case "yaml":
-		err = parseYAMLContent(decrypted, data)
+		return &sopsyaml.Store{}, nil
 	case "json":
-		err = parseJSONContent(decrypted, data)
+		return &sopsjson.Store{}, nil
+	case "dotenv":
+		return &sopsdotenv.Store{}, nil
+	case "binary":
+		return &sopsjson.BinaryStore{}, nil
 	default:
-		err = errors.New("unknown file format, use dotenv, yaml or json")
+		return nil, errors.Errorf("unsupported format %q for store-based decryption", format)
 	}
-	if err != nil {
-		return err
+}
+
+// keyServiceClients builds the list of key-service clients DecryptTree
+// tries in order: the in-process local client sops always supports,
+// followed by one gRPC client per configured sops key-service endpoint,
+// letting decryption go through a remote `sops keyservice` for
+// credentials this process doesn't hold directly.
+func keyServiceClients(uris []string) ([]keyservice.KeyServiceClient, error) {
+	clients := []keyservice.KeyServiceClient{keyservice.NewLocalClient()}
+	for _, uri := range uris {
+		conn, err := grpc.Dial(uri, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, keyservice.NewKeyServiceClient(conn))
 	}
+	return clients, nil
+}
 
-	return nil
+// reorderKeyGroups stable-sorts each key group's master keys so the
+// types named earlier in order are tried first. This lets CI
+// environments that only hold one credential type (e.g. age) skip
+// round-tripping through KMS backends they can't reach.
+func reorderKeyGroups(groups []sops.KeyGroup, order []string) {
+	if len(order) == 0 {
+		return
+	}
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		rank[name] = i
+	}
+	for i := range groups {
+		group := groups[i]
+		sort.SliceStable(group, func(a, b int) bool {
+			return masterKeyRank(group[a], rank) < masterKeyRank(group[b], rank)
+		})
+	}
+}
+
+func masterKeyRank(key keys.MasterKey, rank map[string]int) int {
+	if r, ok := rank[masterKeyType(key)]; ok {
+		return r
+	}
+	return len(rank)
+}
+
+func masterKeyType(key keys.MasterKey) string {
+	switch key.(type) {
+	case *age.MasterKey:
+		return "age"
+	case *pgp.MasterKey:
+		return "pgp"
+	case *kms.MasterKey:
+		return "kms"
+	case *gcpkms.MasterKey:
+		return "gcp-kms"
+	case *azkv.MasterKey:
+		return "azure-kv"
+	case *hcvault.MasterKey:
+		return "hc-vault"
+	default:
+		return ""
+	}
+}
+
+// branchToValue converts a decrypted sops.TreeBranch into the same
+// map[string]interface{}/[]interface{}/scalar shape flattenValue expects,
+// recording in encrypted whether SOPS considered each leaf's path
+// encrypted per tree.Metadata's encrypted_regex/encrypted_suffix/unencrypted_suffix.
+func branchToValue(branch sops.TreeBranch, meta sops.Metadata, prefix, delimiter string, encrypted map[string]bool) map[string]interface{} {
+	m := make(map[string]interface{}, len(branch))
+	for _, item := range branch {
+		key, ok := item.Key.(string)
+		if !ok {
+			continue
+		}
+		m[key] = treeItemValue(item.Value, meta, joinPath(prefix, key, delimiter), delimiter, encrypted)
+	}
+	return m
+}
+
+func treeItemValue(v interface{}, meta sops.Metadata, path, delimiter string, encrypted map[string]bool) interface{} {
+	switch value := v.(type) {
+	case sops.TreeBranch:
+		return branchToValue(value, meta, path, delimiter, encrypted)
+	case []interface{}:
+		s := make([]interface{}, len(value))
+		for i, val := range value {
+			s[i] = treeItemValue(val, meta, fmt.Sprintf("%s[%d]", path, i), delimiter, encrypted)
+		}
+		return s
+	default:
+		encrypted[path] = isEncryptedLeaf(meta, lastPathComponent(path, delimiter))
+		return value
+	}
+}
+
+// isEncryptedLeaf mirrors the precedence SOPS itself uses to decide
+// whether a leaf is selected for encryption: encrypted_regex, then
+// unencrypted_suffix, then encrypted_suffix, defaulting to "encrypted"
+// when none of those are configured.
+func isEncryptedLeaf(meta sops.Metadata, key string) bool {
+	switch {
+	case meta.EncryptedRegex != "":
+		matched, err := regexp.MatchString(meta.EncryptedRegex, key)
+		return err == nil && matched
+	case meta.UnencryptedSuffix != "":
+		return !strings.HasSuffix(key, meta.UnencryptedSuffix)
+	case meta.EncryptedSuffix != "":
+		return strings.HasSuffix(key, meta.EncryptedSuffix)
+	default:
+		return true
+	}
+}
+
+func lastPathComponent(path, delimiter string) string {
+	if i := strings.LastIndex(path, delimiter); i >= 0 {
+		path = path[i+len(delimiter):]
+	}
+	if i := strings.LastIndex(path, "["); i >= 0 {
+		path = path[:i]
+	}
+	return path
 }
 
 func parseDotEnvContent(content []byte, data kvMap) error {
@@ -241,88 +1069,167 @@ func parseDotEnvLine(line []byte, data kvMap) error {
 		return fmt.Errorf("requires value: %v", string(line))
 	}
 
-	data[pair[0]] = base64.StdEncoding.EncodeToString([]byte(pair[1]))
-	return nil
+	return setUnique(data, pair[0], pair[1])
 }
 
-func parseYAMLContent(content []byte, data kvMap) error {
-	d := make(kvMap)
-	err := yaml.Unmarshal(content, &d)
-	if err != nil {
-		return err
+// flattenInto walks a decoded YAML/JSON document and writes its leaves
+// into data as raw (not yet encoded) string values. With source.Flatten,
+// nested objects and arrays are flattened into paths such as db.password
+// or users[0].token; otherwise the document must be a flat string-keyed
+// mapping, matching the generator's original behaviour. Every resulting
+// key must pass isValidDataKey, which does not allow '[' or ']', so a
+// leaf under an array is reported as an invalid key.
+func flattenInto(v interface{}, source EnvSource, data kvMap) error {
+	delimiter := source.Delimiter
+	if delimiter == "" {
+		delimiter = "."
 	}
-	for k, v := range d {
-		data[k] = base64.StdEncoding.EncodeToString([]byte(v))
+
+	leaves := make(map[string]interface{})
+	if source.Flatten {
+		flattenValue("", v, delimiter, leaves)
+	} else {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("top-level value must be a mapping when flatten is false")
+		}
+		for k, val := range m {
+			switch val.(type) {
+			case map[string]interface{}, []interface{}:
+				return errors.Errorf("key %q holds a nested value, set flatten: true to expand it", k)
+			}
+			leaves[k] = val
+		}
+	}
+
+	var invalidKeys []string
+	for k, v := range leaves {
+		if !isValidDataKey(k) {
+			invalidKeys = append(invalidKeys, k)
+			continue
+		}
+		s, err := scalarToString(v)
+		if err != nil {
+			return err
+		}
+		if err := setUnique(data, k, s); err != nil {
+			return err
+		}
+	}
+	if len(invalidKeys) > 0 {
+		sort.Strings(invalidKeys)
+		return errors.Errorf("invalid secret key(s): %s", strings.Join(invalidKeys, ", "))
 	}
 	return nil
 }
 
-func parseJSONContent(content []byte, data kvMap) error {
-	d := make(kvMap)
-	err := json.Unmarshal(content, &d)
-	if err != nil {
-		return err
+func flattenValue(prefix string, v interface{}, delimiter string, leaves map[string]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, val := range value {
+			flattenValue(joinPath(prefix, k, delimiter), val, delimiter, leaves)
+		}
+	case []interface{}:
+		for i, val := range value {
+			flattenValue(fmt.Sprintf("%s[%d]", prefix, i), val, delimiter, leaves)
+		}
+	default:
+		leaves[prefix] = value
 	}
-	for k, v := range d {
-		data[k] = base64.StdEncoding.EncodeToString([]byte(v))
+}
+
+func joinPath(prefix, key, delimiter string) string {
+	if prefix == "" {
+		return key
 	}
-	return nil
+	return prefix + delimiter + key
 }
 
-func parseFileSources(sources []string, data kvMap) error {
+// scalarToString renders a flattened leaf value as the string stored in
+// the Secret: strings pass through untouched, everything else (numbers,
+// booleans, null) is rendered via its canonical JSON encoding.
+func scalarToString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// dataKeyPattern matches the RFC 1123 subset Kubernetes allows for Secret
+// and ConfigMap data keys: alphanumerics, '-', '_' and '.'.
+var dataKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+func isValidDataKey(key string) bool {
+	return dataKeyPattern.MatchString(key)
+}
+
+func parseFileSources(sources []FileSource, opts decryptOptions, dec decryptor, data kvMap) error {
 	for _, source := range sources {
-		err := parseFileSource(source, data)
+		err := parseFileSourceEntry(source, opts, dec, data)
 		if err != nil {
-			return errors.Wrapf(err, "file source %v", source)
+			return errors.Wrapf(err, "file source %v", source.Path)
 		}
 	}
 	return nil
 }
 
-func parseFileSource(source string, data kvMap) error {
-	key, fn, err := parseFileName(source)
-	if err != nil {
-		return err
+func parseFileSourceEntry(source FileSource, opts decryptOptions, dec decryptor, data kvMap) error {
+	if strings.Contains(source.Path, "=") {
+		key, fn, err := parseFileName(source.Path)
+		if err != nil {
+			return err
+		}
+		return readFileSource(fn, source.KeyPrefix+key, opts, dec, data)
 	}
 
-	content, err := ioutil.ReadFile(fn)
+	paths, err := expandSourcePaths(source.Path, false)
 	if err != nil {
 		return err
 	}
+	for _, fn := range paths {
+		key := source.KeyPrefix + path.Base(fn)
+		if err := readFileSource(fn, key, opts, dec, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	decrypted, err := sopsdecrypt.Data(content, formatForPath(source))
+func readFileSource(fn, key string, opts decryptOptions, dec decryptor, data kvMap) error {
+	decrypted, err := dec.decryptBytes(fn, formatForPath(fn), opts)
 	if err != nil {
 		return err
 	}
-
-	data[key] = base64.StdEncoding.EncodeToString(decrypted)
-	return nil
+	return setUnique(data, key, string(decrypted))
 }
 
+// parseFileName splits the legacy explicit "key=path" files syntax. Only
+// entries containing '=' reach it; the path after the '=' is read as a
+// single literal file, not expanded as a glob or directory.
 func parseFileName(source string) (key string, fn string, err error) {
 	components := strings.Split(source, "=")
-	switch len(components) {
-	case 1:
-		return path.Base(source), source, nil
-	case 2:
-		key, fn = components[0], components[1]
-		if key == "" {
-			return "", "", fmt.Errorf("key name for file path %v missing", strings.TrimPrefix(source, "="))
-		} else if fn == "" {
-			return "", "", fmt.Errorf("file path for key name %v missing", strings.TrimSuffix(source, "="))
-		}
-		return key, fn, nil
-	default:
-		return "", "", errors.New("key names or file paths cannot contain '='")
+	if len(components) != 2 {
+		return "", "", errors.New("key names or file paths cannot contain more than one '='")
+	}
+	key, fn = components[0], components[1]
+	if key == "" {
+		return "", "", fmt.Errorf("key name for file path %v missing", strings.TrimPrefix(source, "="))
+	} else if fn == "" {
+		return "", "", fmt.Errorf("file path for key name %v missing", strings.TrimSuffix(source, "="))
 	}
+	return key, fn, nil
 }
 
 func formatForPath(path string) string {
-	if sopscommon.IsYAMLFile(path) {
+	if sopsformats.IsYAMLFile(path) {
 		return "yaml"
-	} else if sopscommon.IsJSONFile(path) {
+	} else if sopsformats.IsJSONFile(path) {
 		return "json"
-	} else if sopscommon.IsEnvFile(path) {
+	} else if sopsformats.IsEnvFile(path) {
 		return "dotenv"
 	}
 	return "binary"
@@ -0,0 +1,174 @@
+// Copyright 2019 Go About B.V.
+// Licensed under the Apache License, Version 2.0.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/keys"
+	"go.mozilla.org/sops/v3/kms"
+	"go.mozilla.org/sops/v3/pgp"
+)
+
+func TestFlattenValue(t *testing.T) {
+	in := map[string]interface{}{
+		"a": "scalar",
+		"b": map[string]interface{}{
+			"c": "nested",
+		},
+		"d": []interface{}{"x", "y"},
+	}
+	leaves := make(map[string]interface{})
+	flattenValue("", in, ".", leaves)
+
+	want := map[string]interface{}{
+		"a":    "scalar",
+		"b.c":  "nested",
+		"d[0]": "x",
+		"d[1]": "y",
+	}
+	if !reflect.DeepEqual(leaves, want) {
+		t.Fatalf("flattenValue() = %#v, want %#v", leaves, want)
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	if got := joinPath("", "a", "."); got != "a" {
+		t.Errorf("joinPath(\"\", \"a\", \".\") = %q, want %q", got, "a")
+	}
+	if got := joinPath("a", "b", "."); got != "a.b" {
+		t.Errorf("joinPath(\"a\", \"b\", \".\") = %q, want %q", got, "a.b")
+	}
+}
+
+func TestLastPathComponent(t *testing.T) {
+	cases := []struct {
+		path, delimiter, want string
+	}{
+		{"a.b.c", ".", "c"},
+		{"a.b[0]", ".", "b"},
+		{"a", ".", "a"},
+	}
+	for _, c := range cases {
+		if got := lastPathComponent(c.path, c.delimiter); got != c.want {
+			t.Errorf("lastPathComponent(%q, %q) = %q, want %q", c.path, c.delimiter, got, c.want)
+		}
+	}
+}
+
+func TestFlattenIntoStrictModeRejectsNestedValues(t *testing.T) {
+	v := map[string]interface{}{
+		"flat":   "ok",
+		"nested": map[string]interface{}{"a": "b"},
+	}
+	data := make(kvMap)
+	err := flattenInto(v, EnvSource{Flatten: false}, data)
+	if err == nil {
+		t.Fatal("flattenInto() with flatten: false and a nested leaf value: want error, got nil")
+	}
+}
+
+func TestIsEncryptedLeaf(t *testing.T) {
+	cases := []struct {
+		name string
+		meta sops.Metadata
+		key  string
+		want bool
+	}{
+		{"default encrypts everything", sops.Metadata{}, "anything", true},
+		{"encrypted_regex matches", sops.Metadata{EncryptedRegex: "^secret_"}, "secret_x", true},
+		{"encrypted_regex does not match", sops.Metadata{EncryptedRegex: "^secret_"}, "plain_x", false},
+		{"unencrypted_suffix excludes", sops.Metadata{UnencryptedSuffix: "_plain"}, "foo_plain", false},
+		{"unencrypted_suffix includes others", sops.Metadata{UnencryptedSuffix: "_plain"}, "foo", true},
+		{"encrypted_suffix includes", sops.Metadata{EncryptedSuffix: "_enc"}, "foo_enc", true},
+		{"encrypted_suffix excludes others", sops.Metadata{EncryptedSuffix: "_enc"}, "foo", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isEncryptedLeaf(c.meta, c.key); got != c.want {
+				t.Errorf("isEncryptedLeaf(%+v, %q) = %v, want %v", c.meta, c.key, got, c.want)
+			}
+		})
+	}
+}
+
+func TestReorderKeyGroups(t *testing.T) {
+	group := sops.KeyGroup{&kms.MasterKey{}, &pgp.MasterKey{}, &age.MasterKey{}}
+	groups := []sops.KeyGroup{group}
+
+	reorderKeyGroups(groups, []string{"age", "pgp", "kms"})
+
+	got := make([]string, len(groups[0]))
+	for i, k := range groups[0] {
+		got[i] = masterKeyType(k)
+	}
+	want := []string{"age", "pgp", "kms"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reorderKeyGroups() order = %v, want %v", got, want)
+	}
+}
+
+func TestReorderKeyGroupsEmptyOrderIsNoop(t *testing.T) {
+	group := sops.KeyGroup{&kms.MasterKey{}, &pgp.MasterKey{}}
+	groups := []sops.KeyGroup{group}
+
+	reorderKeyGroups(groups, nil)
+
+	if !reflect.DeepEqual(groups[0], group) {
+		t.Fatalf("reorderKeyGroups(nil) reordered groups to %v, want unchanged %v", groups[0], group)
+	}
+}
+
+func TestMasterKeyType(t *testing.T) {
+	cases := []struct {
+		key  keys.MasterKey
+		want string
+	}{
+		{&age.MasterKey{}, "age"},
+		{&pgp.MasterKey{}, "pgp"},
+		{&kms.MasterKey{}, "kms"},
+	}
+	for _, c := range cases {
+		if got := masterKeyType(c.key); got != c.want {
+			t.Errorf("masterKeyType(%T) = %q, want %q", c.key, got, c.want)
+		}
+	}
+}
+
+func TestCacheKeyStableAndOptsSensitive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.enc.yaml")
+	if err := os.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := cachingDecryptor{dir: dir}
+	opts := decryptOptions{DecryptionOrder: []string{"age", "pgp"}}
+
+	k1, err := c.cacheKey("tree", path, "yaml", ".", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := c.cacheKey("tree", path, "yaml", ".", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k2 {
+		t.Fatalf("cacheKey() not stable across calls: %q != %q", k1, k2)
+	}
+
+	otherOpts := decryptOptions{DecryptionOrder: []string{"pgp", "age"}}
+	k3, err := c.cacheKey("tree", path, "yaml", ".", otherOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k3 {
+		t.Fatalf("cacheKey() did not change when opts.DecryptionOrder changed")
+	}
+}